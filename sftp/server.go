@@ -1,9 +1,14 @@
 package sftp
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io"
@@ -12,6 +17,9 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"emperror.dev/errors"
 	"github.com/apex/log"
@@ -22,73 +30,257 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// defaultMinimumRSAKeyBits is the smallest RSA host key size we consider
+// acceptable when config.Sftp.MinimumRSAKeyBits is unset.
+const defaultMinimumRSAKeyBits = 3072
+
+// defaultHostKeyMaxAge is how long a host key is trusted before it is
+// regenerated on boot when config.Sftp.HostKeyMaxAge is unset.
+const defaultHostKeyMaxAge = 365 * 24 * time.Hour
+
+// minimumRSAKeyBits returns the configured minimum RSA host key size, falling
+// back to defaultMinimumRSAKeyBits if the operator hasn't set one.
+func minimumRSAKeyBits() int {
+	if n := config.Get().System.Sftp.MinimumRSAKeyBits; n > 0 {
+		return n
+	}
+	return defaultMinimumRSAKeyBits
+}
+
+// hostKeyMaxAge returns the configured host key rotation age, falling back to
+// defaultHostKeyMaxAge if the operator hasn't set one.
+func hostKeyMaxAge() time.Duration {
+	if d := config.Get().System.Sftp.HostKeyMaxAge; d > 0 {
+		return d
+	}
+	return defaultHostKeyMaxAge
+}
+
+// pubkeyCacheTTL controls how long a successfully validated public key is
+// trusted before the panel is asked to re-validate it on the next connection.
+const pubkeyCacheTTL = time.Minute * 5
+
 //goland:noinspection GoNameStartsWithPackageName
 type SFTPServer struct {
 	BasePath    string
 	ReadOnly    bool
 	BindPort    int
 	BindAddress string
+
+	pubkeyCacheMu sync.Mutex
+	pubkeyCache   map[string]pubkeyCacheEntry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	listenerMu sync.Mutex
+	listener   net.Listener
+	wg         sync.WaitGroup
+
+	sessionSeq int64
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*sftpSession
+}
+
+// pubkeyCacheEntry holds the result of a previous key validation so repeated
+// reconnects from the same client don't hit the panel API on every attempt.
+type pubkeyCacheEntry struct {
+	perm    *ssh.Permissions
+	expires time.Time
+}
+
+// sftpSession tracks a single active SFTP connection so it can be reported to
+// operators and force-closed during a shutdown. handler only closes the SFTP
+// channel the request server is bound to; sconn is kept alongside it so a
+// force-close can tear down the whole SSH connection, since closing one
+// channel does not cause AcceptInboundConnection's channel-accept loop to
+// return.
+type sftpSession struct {
+	handler *sftp.RequestServer
+	sconn   *ssh.ServerConn
+
+	User       string
+	ServerUUID string
+	RemoteIP   string
+	StartedAt  time.Time
+
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// Session is a snapshot of an active SFTP connection's metadata, returned by
+// Sessions() for use by things like an admin HTTP endpoint.
+type Session struct {
+	ID           string
+	User         string
+	ServerUUID   string
+	RemoteIP     string
+	StartedAt    time.Time
+	BytesRead    int64
+	BytesWritten int64
 }
 
 var noMatchingServerError = errors.Sentinel("sftp: no matching server with UUID")
+var noMatchingSessionError = errors.Sentinel("sftp: no active session with the given id")
 
 func NewServer() *SFTPServer {
 	cfg := config.Get().System
+	ctx, cancel := context.WithCancel(context.Background())
 	return &SFTPServer{
 		BasePath:    cfg.Data,
 		ReadOnly:    cfg.Sftp.ReadOnly,
 		BindAddress: cfg.Sftp.Address,
 		BindPort:    cfg.Sftp.Port,
+		pubkeyCache: make(map[string]pubkeyCacheEntry),
+		ctx:         ctx,
+		cancel:      cancel,
+		sessions:    make(map[string]*sftpSession),
 	}
 }
 
 // Starts the SFTP server and add a persistent listener to handle inbound SFTP connections.
 func (c *SFTPServer) Run() error {
+	sftpCfg := config.Get().System.Sftp
 	serverConfig := &ssh.ServerConfig{
-		NoClientAuth:     false,
-		MaxAuthTries:     6,
-		PasswordCallback: c.passwordCallback,
+		NoClientAuth:      false,
+		MaxAuthTries:      6,
+		PublicKeyCallback: c.publicKeyCallback,
+		Config: ssh.Config{
+			RekeyThreshold: sftpCfg.RekeyThreshold,
+		},
 	}
 
-	if _, err := os.Stat(path.Join(c.BasePath, ".sftp/id_rsa")); os.IsNotExist(err) {
-		if err := c.generatePrivateKey(); err != nil {
-			return err
-		}
-	} else if err != nil {
-		return err
+	if !sftpCfg.DisablePasswordAuth {
+		serverConfig.PasswordCallback = c.passwordCallback
 	}
 
-	privateBytes, err := ioutil.ReadFile(path.Join(c.BasePath, ".sftp/id_rsa"))
+	signers, err := c.loadOrGenerateHostKeys()
 	if err != nil {
 		return err
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return err
+	// ssh.ServerConfig has no allow-list of its own; the algorithms a server
+	// offers are simply whichever host keys are registered with it, so we
+	// filter the signers down to the configured allow-list ourselves.
+	for _, signer := range signers {
+		if len(sftpCfg.HostKeyAlgorithms) > 0 && !stringSliceContains(sftpCfg.HostKeyAlgorithms, signer.PublicKey().Type()) {
+			continue
+		}
+		serverConfig.AddHostKey(signer)
 	}
 
-	// Add our private key to the server configuration.
-	serverConfig.AddHostKey(private)
-
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
 	if err != nil {
 		return err
 	}
+	c.setListener(listener)
 
 	log.WithField("host", c.BindAddress).WithField("port", c.BindPort).Info("sftp subsystem listening for connections")
 
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.pubkeyCacheSweepLoop()
+	}()
+
 	for {
-		conn, _ := listener.Accept()
-		if conn != nil {
-			go c.AcceptInboundConnection(conn, serverConfig)
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-c.ctx.Done():
+				return nil
+			default:
+				return err
+			}
 		}
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.AcceptInboundConnection(conn, serverConfig)
+		}()
+	}
+}
+
+// Shutdown closes the listener and stops accepting new connections, then
+// waits for in-flight transfers to finish until the provided context is
+// cancelled or its deadline expires, at which point any still-active
+// sessions are force-closed.
+func (c *SFTPServer) Shutdown(ctx context.Context) error {
+	c.cancel()
+
+	if listener := c.getListener(); listener != nil {
+		if err := listener.Close(); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.sessionsMu.Lock()
+		for id, s := range c.sessions {
+			log.WithField("subsystem", "sftp").WithField("session", id).Warn("force-closing SFTP session during shutdown")
+			s.handler.Close()
+			s.sconn.Close()
+		}
+		c.sessionsMu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// Sessions returns metadata about every currently active SFTP connection, for
+// use by things like an admin HTTP endpoint that lists or kills sessions.
+func (c *SFTPServer) Sessions() []Session {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+
+	sessions := make([]Session, 0, len(c.sessions))
+	for id, s := range c.sessions {
+		sessions = append(sessions, Session{
+			ID:           id,
+			User:         s.User,
+			ServerUUID:   s.ServerUUID,
+			RemoteIP:     s.RemoteIP,
+			StartedAt:    s.StartedAt,
+			BytesRead:    atomic.LoadInt64(&s.bytesRead),
+			BytesWritten: atomic.LoadInt64(&s.bytesWritten),
+		})
+	}
+
+	return sessions
+}
+
+// CloseSession force-closes a single active SFTP session by the ID reported
+// through Sessions(), tearing down the whole SSH connection it belongs to so
+// the associated accept goroutine can exit. Returns noMatchingSessionError if
+// no session with that ID is currently active.
+func (c *SFTPServer) CloseSession(id string) error {
+	c.sessionsMu.Lock()
+	s, ok := c.sessions[id]
+	c.sessionsMu.Unlock()
+
+	if !ok {
+		return noMatchingSessionError
 	}
+
+	s.handler.Close()
+
+	return s.sconn.Close()
 }
 
 // Handles an inbound connection to the instance and determines if we should serve the request
 // or not.
-func (c SFTPServer) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
+func (c *SFTPServer) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
 	defer conn.Close()
 
 	// Before beginning a handshake must be performed on the incoming net.Conn
@@ -137,14 +329,84 @@ func (c SFTPServer) AcceptInboundConnection(conn net.Conn, config *ssh.ServerCon
 		// Create a new handler for the currently logged in user's server.
 		fs := c.newHandler(sconn)
 
+		// A single SSH connection may open more than one "session" channel, so
+		// the raw SSH session ID alone isn't a unique key - append a
+		// per-channel sequence number to avoid two concurrent channels on the
+		// same connection clobbering each other's tracked session.
+		sessionID := fmt.Sprintf("%s-%d", hex.EncodeToString(sconn.SessionID()), atomic.AddInt64(&c.sessionSeq, 1))
+		sess := &sftpSession{
+			sconn:      sconn,
+			User:       sconn.User(),
+			ServerUUID: sconn.Permissions.Extensions["uuid"],
+			RemoteIP:   conn.RemoteAddr().String(),
+			StartedAt:  time.Now(),
+		}
+		tracked := &trackedChannel{Channel: channel, session: sess}
+
 		// Create the server instance for the channel using the filesystem we created above.
-		handler := sftp.NewRequestServer(channel, fs)
+		handler := sftp.NewRequestServer(tracked, fs)
+		sess.handler = handler
+
+		c.registerSession(sessionID, sess)
 		if err := handler.Serve(); err == io.EOF {
 			handler.Close()
 		}
+		c.removeSession(sessionID)
 	}
 }
 
+// setListener records the listener Run() is accepting connections on so that
+// Shutdown(), which typically runs on a different goroutine, can close it.
+func (c *SFTPServer) setListener(l net.Listener) {
+	c.listenerMu.Lock()
+	c.listener = l
+	c.listenerMu.Unlock()
+}
+
+// getListener returns the listener previously recorded by setListener, or nil
+// if Run() hasn't gotten that far yet.
+func (c *SFTPServer) getListener() net.Listener {
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	return c.listener
+}
+
+// registerSession records a newly established SFTP session so it is returned
+// by Sessions() and can be force-closed by Shutdown().
+func (c *SFTPServer) registerSession(id string, s *sftpSession) {
+	c.sessionsMu.Lock()
+	c.sessions[id] = s
+	c.sessionsMu.Unlock()
+}
+
+// removeSession removes a session once its handler has stopped serving
+// requests, either because the client disconnected or it was force-closed.
+func (c *SFTPServer) removeSession(id string) {
+	c.sessionsMu.Lock()
+	delete(c.sessions, id)
+	c.sessionsMu.Unlock()
+}
+
+// trackedChannel wraps an ssh.Channel and records the number of bytes read
+// from and written to it on the associated session, so Sessions() can report
+// transfer progress for diagnosing runaway transfers.
+type trackedChannel struct {
+	ssh.Channel
+	session *sftpSession
+}
+
+func (t *trackedChannel) Read(data []byte) (int, error) {
+	n, err := t.Channel.Read(data)
+	atomic.AddInt64(&t.session.bytesRead, int64(n))
+	return n, err
+}
+
+func (t *trackedChannel) Write(data []byte) (int, error) {
+	n, err := t.Channel.Write(data)
+	atomic.AddInt64(&t.session.bytesWritten, int64(n))
+	return n, err
+}
+
 // Creates a new SFTP handler for a given server. The directory argument should
 // be the base directory for a server. All actions done on the server will be
 // relative to that directory, and the user will not be able to escape out of it.
@@ -172,33 +434,174 @@ func (c *SFTPServer) newHandler(sc *ssh.ServerConn) sftp.Handlers {
 	}
 }
 
-// Generates a private key that will be used by the SFTP server.
-func (c *SFTPServer) generatePrivateKey() error {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
+// loadOrGenerateHostKeys ensures an RSA, Ed25519 and ECDSA host key all exist
+// in the ".sftp" directory, generating (or regenerating) any that are missing
+// or that no longer meet our minimum strength requirements, and returns the
+// parsed signers so they can all be registered on the server configuration.
+// Offering multiple key types lets connecting clients negotiate whichever
+// algorithm they support, including clients that have disabled "ssh-rsa".
+func (c *SFTPServer) loadOrGenerateHostKeys() ([]ssh.Signer, error) {
+	if err := os.MkdirAll(path.Join(c.BasePath, ".sftp"), 0755); err != nil {
+		return nil, err
 	}
 
-	if err := os.MkdirAll(path.Join(c.BasePath, ".sftp"), 0755); err != nil {
+	if err := c.ensureRSAHostKey(); err != nil {
+		return nil, err
+	}
+	if err := c.ensureHostKey("id_ed25519", generateEd25519HostKey); err != nil {
+		return nil, err
+	}
+	if err := c.ensureHostKey("id_ecdsa", generateECDSAHostKey); err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_rsa", "id_ed25519", "id_ecdsa"} {
+		b, err := ioutil.ReadFile(path.Join(c.BasePath, ".sftp", name))
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// ensureRSAHostKey generates a new RSA host key if one does not already
+// exist, if the existing key is below minimumRSAKeyBits, or if it is older
+// than hostKeyMaxAge.
+func (c *SFTPServer) ensureRSAHostKey() error {
+	p := path.Join(c.BasePath, ".sftp", "id_rsa")
+	logger := log.WithField("subsystem", "sftp").WithField("host_key", "id_rsa")
+
+	if info, err := os.Stat(p); err == nil {
+		tooWeak := true
+		if b, rerr := ioutil.ReadFile(p); rerr == nil {
+			if block, _ := pem.Decode(b); block != nil {
+				if key, kerr := x509.ParsePKCS1PrivateKey(block.Bytes); kerr == nil {
+					tooWeak = key.N.BitLen() < minimumRSAKeyBits()
+				}
+			}
+		}
+
+		switch {
+		case tooWeak:
+			logger.Warn("existing RSA host key is weaker than the configured minimum, regenerating")
+		case time.Since(info.ModTime()) >= hostKeyMaxAge():
+			logger.Warn("existing RSA host key is older than the configured maximum age, rotating")
+		default:
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
 		return err
 	}
 
-	o, err := os.OpenFile(path.Join(c.BasePath, ".sftp/id_rsa"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	key, err := rsa.GenerateKey(rand.Reader, minimumRSAKeyBits())
 	if err != nil {
 		return err
 	}
-	defer o.Close()
 
-	pkey := &pem.Block{
+	block := &pem.Block{
 		Type:  "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(key),
 	}
 
-	if err := pem.Encode(o, pkey); err != nil {
+	return writeHostKeyAtomically(p, block)
+}
+
+// ensureHostKey generates a host key at the given filename using the provided
+// generator function if one does not already exist or if it is older than
+// hostKeyMaxAge.
+func (c *SFTPServer) ensureHostKey(filename string, generate func() (*pem.Block, error)) error {
+	p := path.Join(c.BasePath, ".sftp", filename)
+
+	if info, err := os.Stat(p); err == nil {
+		if time.Since(info.ModTime()) < hostKeyMaxAge() {
+			return nil
+		}
+		log.WithField("subsystem", "sftp").WithField("host_key", filename).Warn("existing host key is older than the configured maximum age, rotating")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	block, err := generate()
+	if err != nil {
+		return err
+	}
+
+	return writeHostKeyAtomically(p, block)
+}
+
+// stringSliceContains reports whether v is present in s.
+func stringSliceContains(s []string, v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHostKeyAtomically writes the PEM-encoded key to a temporary file in the
+// same directory and renames it into place, so a crash mid-write does not
+// leave a truncated key at p that loadOrGenerateHostKeys would then fail to
+// parse on the next boot.
+func writeHostKeyAtomically(p string, block *pem.Block) error {
+	tmp := p + ".tmp"
+
+	o, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(o, block); err != nil {
+		o.Close()
 		return err
 	}
 
-	return nil
+	if err := o.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// generateEd25519HostKey creates a new Ed25519 private key and PEM-encodes it
+// in PKCS#8 form.
+func generateEd25519HostKey() (*pem.Block, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, nil
+}
+
+// generateECDSAHostKey creates a new P-256 ECDSA private key and PEM-encodes
+// it in SEC 1 form.
+func generateECDSAHostKey() (*pem.Block, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
 }
 
 // A function capable of validating user credentials with the Panel API.
@@ -235,3 +638,115 @@ func (c *SFTPServer) passwordCallback(conn ssh.ConnMetadata, pass []byte) (*ssh.
 
 	return sshPerm, nil
 }
+
+// A function capable of validating a user's public key with the Panel API. The
+// fingerprint of the offered key is cached for a short period of time so that
+// repeated reconnects from the same client don't hammer the panel.
+func (c *SFTPServer) publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	cacheKey := conn.User() + ":" + fingerprint
+
+	logger := log.WithFields(log.Fields{
+		"subsystem":   "sftp",
+		"username":    conn.User(),
+		"ip":          conn.RemoteAddr().String(),
+		"fingerprint": fingerprint,
+	})
+
+	if perm, ok := c.pubkeyFromCache(cacheKey); ok {
+		logger.Debug("authenticated SFTP connection using cached public key validation")
+		return perm, nil
+	}
+
+	request := api.SftpAuthKeyRequest{
+		User:              conn.User(),
+		FingerprintSHA256: fingerprint,
+		IP:                conn.RemoteAddr().String(),
+		SessionID:         conn.SessionID(),
+		ClientVersion:     conn.ClientVersion(),
+	}
+
+	logger.Debug("validating public key for SFTP connection")
+
+	resp, err := api.New().ValidateSftpKey(request)
+	if err != nil {
+		if api.IsInvalidCredentialsError(err) {
+			logger.Warn("failed to validate public key (not recognized for any server)")
+		} else {
+			logger.Error("encountered an error while trying to validate public key")
+		}
+		return nil, err
+	}
+
+	logger.WithField("server", resp.Server).Debug("public key validated and matched to server instance")
+	sshPerm := &ssh.Permissions{
+		Extensions: map[string]string{
+			"uuid":        resp.Server,
+			"user":        conn.User(),
+			"permissions": strings.Join(resp.Permissions, ","),
+		},
+	}
+
+	c.pubkeyStoreInCache(cacheKey, sshPerm)
+
+	return sshPerm, nil
+}
+
+// pubkeyCacheSweepLoop periodically purges expired entries from pubkeyCache so
+// a key that's validated once and never seen again doesn't sit in the map for
+// the lifetime of the daemon. It returns once the server's context is
+// cancelled, e.g. during Shutdown().
+func (c *SFTPServer) pubkeyCacheSweepLoop() {
+	ticker := time.NewTicker(pubkeyCacheTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.pubkeyCacheSweep()
+		}
+	}
+}
+
+// pubkeyCacheSweep removes every entry from pubkeyCache that has expired.
+func (c *SFTPServer) pubkeyCacheSweep() {
+	now := time.Now()
+
+	c.pubkeyCacheMu.Lock()
+	defer c.pubkeyCacheMu.Unlock()
+
+	for key, entry := range c.pubkeyCache {
+		if now.After(entry.expires) {
+			delete(c.pubkeyCache, key)
+		}
+	}
+}
+
+// pubkeyFromCache returns a previously cached permission set for the given
+// user/fingerprint pair, provided it has not yet expired.
+func (c *SFTPServer) pubkeyFromCache(key string) (*ssh.Permissions, bool) {
+	c.pubkeyCacheMu.Lock()
+	defer c.pubkeyCacheMu.Unlock()
+
+	entry, ok := c.pubkeyCache[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.pubkeyCache, key)
+		return nil, false
+	}
+
+	return entry.perm, true
+}
+
+// pubkeyStoreInCache records a successful key validation so it can be reused
+// for the duration of pubkeyCacheTTL.
+func (c *SFTPServer) pubkeyStoreInCache(key string, perm *ssh.Permissions) {
+	c.pubkeyCacheMu.Lock()
+	defer c.pubkeyCacheMu.Unlock()
+
+	c.pubkeyCache[key] = pubkeyCacheEntry{
+		perm:    perm,
+		expires: time.Now().Add(pubkeyCacheTTL),
+	}
+}